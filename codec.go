@@ -0,0 +1,224 @@
+/*
+Copyright 2022 The BeeThings Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/beeedge/beethings/pkg/device-access/rest/models"
+)
+
+// reorderWords rearranges the 16-bit words of a register payload according to
+// byteOrder so that it is always left with big-endian, most-significant-word-first
+// bytes before the numeric decode runs. Supported orders: ABCD (big-endian, the
+// default), DCBA (little-endian), BADC (byte-swapped), CDAB (word-swapped).
+func reorderWords(data []byte, byteOrder string) ([]byte, error) {
+	out := make([]byte, len(data))
+	copy(out, data)
+	switch byteOrder {
+	case "", models.ModbusByteOrderABCD:
+		return out, nil
+	case models.ModbusByteOrderDCBA:
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+		return out, nil
+	case models.ModbusByteOrderBADC:
+		for i := 0; i+1 < len(out); i += 2 {
+			out[i], out[i+1] = out[i+1], out[i]
+		}
+		return out, nil
+	case models.ModbusByteOrderCDAB:
+		if len(out)%4 != 0 {
+			return nil, fmt.Errorf("CDAB byte order requires a multiple of 4 bytes, got %d", len(out))
+		}
+		for i := 0; i+3 < len(out); i += 4 {
+			out[i], out[i+1], out[i+2], out[i+3] = out[i+2], out[i+3], out[i], out[i+1]
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported modbus byte order %q", byteOrder)
+	}
+}
+
+// decodeValue turns a register/coil payload into its textual value according to
+// param.DataType, applying word reordering, linear scaling (value*Scale+Offset)
+// and bit-field extraction for packed status registers.
+func decodeValue(data []byte, param models.FeatureMapParam) (string, error) {
+	if param.BitmaskPosition > 0 {
+		if len(data) < 2 {
+			return "", fmt.Errorf("bitmask decode requires at least 2 bytes, got %d", len(data))
+		}
+		word := binary.BigEndian.Uint16(data[:2])
+		bit := (word >> (param.BitmaskPosition - 1)) & 0x1
+		return strconv.FormatUint(uint64(bit), 10), nil
+	}
+	if param.DataType != "" && isBitRegisterType(param.RegisterType) {
+		return "", fmt.Errorf("data type %q is not supported on register type %q: coil/discrete values are single bits, not typed words", param.DataType, param.RegisterType)
+	}
+
+	ordered, err := reorderWords(data, param.ByteOrder)
+	if err != nil {
+		return "", err
+	}
+
+	switch param.DataType {
+	case models.ModbusDataTypeString, "":
+		if param.DataType == "" {
+			// No data type configured: fall back to the historical raw-hex behavior.
+			if len(ordered) < 2 {
+				ordered = append(ordered, 0)
+			}
+			return strconv.FormatUint(uint64(binary.BigEndian.Uint16(ordered[:2])), 16), nil
+		}
+		return string(ordered), nil
+	case models.ModbusDataTypeInt16:
+		return formatScaled(float64(int16(binary.BigEndian.Uint16(ordered))), param), nil
+	case models.ModbusDataTypeUint16:
+		return formatScaled(float64(binary.BigEndian.Uint16(ordered)), param), nil
+	case models.ModbusDataTypeInt32:
+		return formatScaled(float64(int32(binary.BigEndian.Uint32(ordered))), param), nil
+	case models.ModbusDataTypeUint32:
+		return formatScaled(float64(binary.BigEndian.Uint32(ordered)), param), nil
+	case models.ModbusDataTypeFloat32:
+		return formatScaled(float64(math.Float32frombits(binary.BigEndian.Uint32(ordered))), param), nil
+	case models.ModbusDataTypeFloat64:
+		return formatScaled(math.Float64frombits(binary.BigEndian.Uint64(ordered)), param), nil
+	default:
+		return "", fmt.Errorf("unsupported modbus data type %q", param.DataType)
+	}
+}
+
+// encodeValue turns a textual value into the register/coil payload bytes,
+// applying the inverse linear scaling and word order before returning.
+func encodeValue(value string, param models.FeatureMapParam) ([]byte, error) {
+	if param.DataType != "" && isBitRegisterType(param.RegisterType) {
+		return nil, fmt.Errorf("data type %q is not supported on register type %q: coil/discrete values are single bits, not typed words", param.DataType, param.RegisterType)
+	}
+	var raw []byte
+	switch param.DataType {
+	case "":
+		// No data type configured: fall back to the historical encoding of each pair
+		// of ASCII decimal digits as one raw byte, sized to the register/coil count.
+		byteLen := param.RegisterNum
+		if param.RegisterType == models.ModbusRegisterTypeHolding {
+			byteLen *= 2
+		}
+		raw = make([]byte, byteLen)
+		for i := 0; i < byteLen; i++ {
+			if 2*(i+1)-1 < len(value) {
+				v, err := strconv.ParseUint(value[2*i:2*(i+1)], 10, 16)
+				if err != nil {
+					return nil, err
+				}
+				raw[i] = uint8(v)
+			}
+		}
+		return raw, nil
+	case models.ModbusDataTypeString:
+		raw = []byte(value)
+	case models.ModbusDataTypeInt16:
+		v, err := parseScaled(value, param)
+		if err != nil {
+			return nil, err
+		}
+		raw = make([]byte, 2)
+		binary.BigEndian.PutUint16(raw, uint16(int16(v)))
+	case models.ModbusDataTypeUint16:
+		v, err := parseScaled(value, param)
+		if err != nil {
+			return nil, err
+		}
+		raw = make([]byte, 2)
+		binary.BigEndian.PutUint16(raw, uint16(v))
+	case models.ModbusDataTypeInt32:
+		v, err := parseScaled(value, param)
+		if err != nil {
+			return nil, err
+		}
+		raw = make([]byte, 4)
+		binary.BigEndian.PutUint32(raw, uint32(int32(v)))
+	case models.ModbusDataTypeUint32:
+		v, err := parseScaled(value, param)
+		if err != nil {
+			return nil, err
+		}
+		raw = make([]byte, 4)
+		binary.BigEndian.PutUint32(raw, uint32(v))
+	case models.ModbusDataTypeFloat32:
+		v, err := parseScaled(value, param)
+		if err != nil {
+			return nil, err
+		}
+		raw = make([]byte, 4)
+		binary.BigEndian.PutUint32(raw, math.Float32bits(float32(v)))
+	case models.ModbusDataTypeFloat64:
+		v, err := parseScaled(value, param)
+		if err != nil {
+			return nil, err
+		}
+		raw = make([]byte, 8)
+		binary.BigEndian.PutUint64(raw, math.Float64bits(v))
+	default:
+		return nil, fmt.Errorf("unsupported modbus data type %q", param.DataType)
+	}
+	return reorderWords(raw, param.ByteOrder)
+}
+
+// formatScaled applies param.Scale/param.Offset (value*Scale+Offset, defaulting
+// Scale to 1 when unset) and formats the result, trimming to an integer string
+// when no scaling was configured.
+func formatScaled(v float64, param models.FeatureMapParam) string {
+	scale := param.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	scaled := v*scale + param.Offset
+	switch param.DataType {
+	case models.ModbusDataTypeFloat32, models.ModbusDataTypeFloat64:
+		return strconv.FormatFloat(scaled, 'f', -1, 64)
+	}
+	if scale == 1 && param.Offset == 0 {
+		return strconv.FormatInt(int64(scaled), 10)
+	}
+	return strconv.FormatFloat(scaled, 'f', -1, 64)
+}
+
+// isBitRegisterType reports whether registerType addresses single-bit values (coils,
+// discrete inputs), for which a numeric DataType makes no sense: buildRequestPDU's
+// single/multi-coil write PDUs and a device's coil read response both carry one on/off
+// bit per register, not a typed multi-byte word.
+func isBitRegisterType(registerType string) bool {
+	return registerType == models.ModbusRegisterTypeCoil || registerType == models.ModbusRegisterTypeDiscrete
+}
+
+// parseScaled is the inverse of formatScaled: it parses value and removes the
+// configured scale/offset before the result is written back to the register.
+func parseScaled(value string, param models.FeatureMapParam) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	scale := param.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return (v - param.Offset) / scale, nil
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2022 The BeeThings Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/beeedge/beethings/pkg/device-access/rest/models"
+)
+
+func TestEncodeDecodeValueRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		param models.FeatureMapParam
+		value string
+	}{
+		{"holding int16 big-endian", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 1, DataType: models.ModbusDataTypeInt16, ByteOrder: models.ModbusByteOrderABCD}, "-1234"},
+		{"holding uint16 big-endian", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 1, DataType: models.ModbusDataTypeUint16, ByteOrder: models.ModbusByteOrderABCD}, "65000"},
+		{"holding int32 ABCD", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 2, DataType: models.ModbusDataTypeInt32, ByteOrder: models.ModbusByteOrderABCD}, "-70000"},
+		{"holding int32 CDAB word-swapped", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 2, DataType: models.ModbusDataTypeInt32, ByteOrder: models.ModbusByteOrderCDAB}, "-70000"},
+		{"holding int32 DCBA little-endian", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 2, DataType: models.ModbusDataTypeInt32, ByteOrder: models.ModbusByteOrderDCBA}, "70000"},
+		{"holding int32 BADC byte-swapped", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 2, DataType: models.ModbusDataTypeInt32, ByteOrder: models.ModbusByteOrderBADC}, "70000"},
+		{"holding uint32", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 2, DataType: models.ModbusDataTypeUint32, ByteOrder: models.ModbusByteOrderABCD}, "4000000000"},
+		{"holding float32", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 2, DataType: models.ModbusDataTypeFloat32, ByteOrder: models.ModbusByteOrderABCD}, "23.5"},
+		{"holding float32 CDAB", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 2, DataType: models.ModbusDataTypeFloat32, ByteOrder: models.ModbusByteOrderCDAB}, "23.5"},
+		{"holding float64", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 4, DataType: models.ModbusDataTypeFloat64, ByteOrder: models.ModbusByteOrderABCD}, "1234.5678"},
+		{"holding string", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 4, DataType: models.ModbusDataTypeString}, "ABCDEFGH"},
+		{"holding scaled uint16", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, RegisterNum: 1, DataType: models.ModbusDataTypeUint16, Scale: 0.1}, "12.3"},
+		{"input uint16 big-endian", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeInput, RegisterNum: 1, DataType: models.ModbusDataTypeUint16, ByteOrder: models.ModbusByteOrderABCD}, "65000"},
+		{"input float32 CDAB word-swapped", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeInput, RegisterNum: 2, DataType: models.ModbusDataTypeFloat32, ByteOrder: models.ModbusByteOrderCDAB}, "23.5"},
+		{"input int32 BADC byte-swapped", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeInput, RegisterNum: 2, DataType: models.ModbusDataTypeInt32, ByteOrder: models.ModbusByteOrderBADC}, "70000"},
+		{"input float64", models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeInput, RegisterNum: 4, DataType: models.ModbusDataTypeFloat64, ByteOrder: models.ModbusByteOrderABCD}, "1234.5678"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := encodeValue(tc.value, tc.param)
+			if err != nil {
+				t.Fatalf("encodeValue: %v", err)
+			}
+			decoded, err := decodeValue(raw, tc.param)
+			if err != nil {
+				t.Fatalf("decodeValue: %v", err)
+			}
+			if decoded != tc.value {
+				t.Errorf("round trip = %q, want %q (raw bytes %x)", decoded, tc.value, raw)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeValueLegacyFallback(t *testing.T) {
+	// With no DataType configured, encodeValue/decodeValue fall back to the historical
+	// behavior: ASCII decimal digit pairs in, big-endian hex-formatted uint16 out.
+	param := models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeCoil, RegisterNum: 1}
+	raw, err := encodeValue("01", param)
+	if err != nil {
+		t.Fatalf("encodeValue: %v", err)
+	}
+	if string(raw) != string([]byte{1}) {
+		t.Errorf("raw = %x, want 01", raw)
+	}
+	decoded, err := decodeValue(raw, param)
+	if err != nil {
+		t.Fatalf("decodeValue: %v", err)
+	}
+	if decoded != "100" {
+		t.Errorf("decoded = %q, want \"100\"", decoded)
+	}
+}
+
+func TestEncodeDecodeValueRejectsTypedCoil(t *testing.T) {
+	// Coil/discrete values are single on/off bits on the wire, not typed numeric words;
+	// a feature map entry combining the two would silently corrupt writes (see
+	// buildRequestPDU's FuncWriteSingleCoil/FuncWriteMultipleCoils), so it must be rejected
+	// up front instead.
+	for _, registerType := range []string{models.ModbusRegisterTypeCoil, models.ModbusRegisterTypeDiscrete} {
+		param := models.FeatureMapParam{RegisterType: registerType, RegisterNum: 1, DataType: models.ModbusDataTypeUint16}
+		if _, err := encodeValue("1", param); err == nil {
+			t.Errorf("encodeValue with RegisterType %q and DataType %q: expected an error, got nil", registerType, param.DataType)
+		}
+		if _, err := decodeValue([]byte{0x00, 0x01}, param); err == nil {
+			t.Errorf("decodeValue with RegisterType %q and DataType %q: expected an error, got nil", registerType, param.DataType)
+		}
+	}
+}
+
+func TestDecodeValueBitmask(t *testing.T) {
+	param := models.FeatureMapParam{RegisterType: models.ModbusRegisterTypeHolding, BitmaskPosition: 3}
+	decoded, err := decodeValue([]byte{0x00, 0x04}, param) // bit 3 (1-indexed) set
+	if err != nil {
+		t.Fatalf("decodeValue: %v", err)
+	}
+	if decoded != "1" {
+		t.Errorf("decodeValue bit 3 = %q, want \"1\"", decoded)
+	}
+}
+
+func TestBuildAndParseRequestPDU(t *testing.T) {
+	tests := []struct {
+		name      string
+		funcCode  byte
+		startAddr uint16
+		quantity  uint16
+		bytes     []byte
+		wantPDU   []byte
+	}{
+		{"read holding registers", FuncReadHoldingRegisters, 0x0001, 0x0002, nil, []byte{0x03, 0x00, 0x01, 0x00, 0x02}},
+		{"read coils", FuncReadCoils, 0x0000, 0x0008, nil, []byte{0x01, 0x00, 0x00, 0x00, 0x08}},
+		{"read input registers", FuncReadInputRegisters, 0x0004, 0x0001, nil, []byte{0x04, 0x00, 0x04, 0x00, 0x01}},
+		{"read discrete inputs", FuncReadDiscreteInputs, 0x0000, 0x0001, nil, []byte{0x02, 0x00, 0x00, 0x00, 0x01}},
+		{"write single coil on", FuncWriteSingleCoil, 0x0000, 0, []byte{1}, []byte{0x05, 0x00, 0x00, 0xFF, 0x00}},
+		{"write single register", FuncWriteSingleRegister, 0x0001, 0, []byte{0x00, 0x2A}, []byte{0x06, 0x00, 0x01, 0x00, 0x2A}},
+		{"write multiple registers", FuncWriteMultipleRegisters, 0x0000, 2, []byte{0x00, 0x01, 0x00, 0x02}, []byte{0x10, 0x00, 0x00, 0x00, 0x02, 0x04, 0x00, 0x01, 0x00, 0x02}},
+		{"write multiple coils", FuncWriteMultipleCoils, 0x0000, 10, []byte{1, 0, 1, 1, 0, 0, 0, 0, 1, 0}, []byte{0x0F, 0x00, 0x00, 0x00, 0x0A, 0x02, 0x0D, 0x01}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pdu, err := buildRequestPDU(tc.funcCode, tc.startAddr, tc.quantity, tc.bytes)
+			if err != nil {
+				t.Fatalf("buildRequestPDU: %v", err)
+			}
+			if string(pdu) != string(tc.wantPDU) {
+				t.Errorf("buildRequestPDU = %x, want %x", pdu, tc.wantPDU)
+			}
+		})
+	}
+}
+
+func TestParseResponsePDUException(t *testing.T) {
+	resp := []byte{FuncReadHoldingRegisters | 0x80, 0x02}
+	_, err := parseResponsePDU(resp[0], resp)
+	if err == nil {
+		t.Fatal("expected a *ModbusException, got nil error")
+	}
+	modbusErr, ok := err.(*ModbusException)
+	if !ok {
+		t.Fatalf("expected *ModbusException, got %T", err)
+	}
+	if modbusErr.FunctionCode != FuncReadHoldingRegisters || modbusErr.ExceptionCode != 0x02 {
+		t.Errorf("got %+v, want FunctionCode=0x03 ExceptionCode=0x02", modbusErr)
+	}
+}
+
+func TestParseResponsePDUReadPayload(t *testing.T) {
+	resp := []byte{FuncReadHoldingRegisters, 0x02, 0x00, 0x2A}
+	payload, err := parseResponsePDU(resp[0], resp)
+	if err != nil {
+		t.Fatalf("parseResponsePDU: %v", err)
+	}
+	if string(payload) != string([]byte{0x00, 0x2A}) {
+		t.Errorf("payload = %x, want 002a", payload)
+	}
+}
+
+func TestSimulatedDeviceRoundTrip(t *testing.T) {
+	fixture := `
+deviceId: dev-1
+registers:
+  - registerType: HOLDING
+    address: 0
+    values: [0x00, 0x2A]
+  - registerType: COIL
+    address: 0
+    values: [1]
+`
+	dev, err := newSimulatedDeviceFromFixture([]byte(fixture))
+	if err != nil {
+		t.Fatalf("newSimulatedDeviceFromFixture: %v", err)
+	}
+
+	readReq, err := buildRequestPDU(FuncReadHoldingRegisters, 0, 1, nil)
+	if err != nil {
+		t.Fatalf("buildRequestPDU: %v", err)
+	}
+	resp, err := dev.Handle(readReq)
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	payload, err := parseResponsePDU(resp[0], resp)
+	if err != nil {
+		t.Fatalf("parseResponsePDU: %v", err)
+	}
+	if string(payload) != string([]byte{0x00, 0x2A}) {
+		t.Errorf("holding register payload = %x, want 002a", payload)
+	}
+
+	coilReadReq, err := buildRequestPDU(FuncReadCoils, 0, 1, nil)
+	if err != nil {
+		t.Fatalf("buildRequestPDU: %v", err)
+	}
+	coilResp, err := dev.Handle(coilReadReq)
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	coilPayload, err := parseResponsePDU(coilResp[0], coilResp)
+	if err != nil {
+		t.Fatalf("parseResponsePDU: %v", err)
+	}
+	if coilPayload[0]&0x1 != 1 {
+		t.Errorf("coil payload = %x, want bit 0 set", coilPayload)
+	}
+}
+
+func TestSimulatedDeviceMultiCoilWriteRoundTrip(t *testing.T) {
+	fixture := `
+deviceId: dev-1
+registers:
+  - registerType: COIL
+    address: 0
+    values: [0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+`
+	dev, err := newSimulatedDeviceFromFixture([]byte(fixture))
+	if err != nil {
+		t.Fatalf("newSimulatedDeviceFromFixture: %v", err)
+	}
+
+	writeReq, err := buildRequestPDU(FuncWriteMultipleCoils, 0, 10, []byte{1, 0, 1, 1, 0, 0, 0, 0, 1, 0})
+	if err != nil {
+		t.Fatalf("buildRequestPDU: %v", err)
+	}
+	if _, err := dev.Handle(writeReq); err != nil {
+		t.Fatalf("Handle write: %v", err)
+	}
+
+	readReq, err := buildRequestPDU(FuncReadCoils, 0, 10, nil)
+	if err != nil {
+		t.Fatalf("buildRequestPDU: %v", err)
+	}
+	resp, err := dev.Handle(readReq)
+	if err != nil {
+		t.Fatalf("Handle read: %v", err)
+	}
+	payload, err := parseResponsePDU(resp[0], resp)
+	if err != nil {
+		t.Fatalf("parseResponsePDU: %v", err)
+	}
+	want := []byte{0x0D, 0x01} // bits 0,2,3 set in byte 0; bit 8 set in byte 1
+	if string(payload) != string(want) {
+		t.Errorf("coil payload after multi-coil write = %x, want %x", payload, want)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2022 The BeeThings Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/beeedge/beethings/pkg/device-access/rest/models"
+)
+
+// Modbus function codes supported by the converter. Read codes are distinguished
+// from write codes so that ConvertIssueMessage2Device knows how to frame the
+// request PDU and ConvertDeviceMessages2MQFormat knows how to parse the reply.
+const (
+	FuncReadCoils              byte = 0x01
+	FuncReadDiscreteInputs     byte = 0x02
+	FuncReadHoldingRegisters   byte = 0x03
+	FuncReadInputRegisters     byte = 0x04
+	FuncWriteSingleCoil        byte = 0x05
+	FuncWriteSingleRegister    byte = 0x06
+	FuncWriteMultipleCoils     byte = 0x0F
+	FuncWriteMultipleRegisters byte = 0x10
+
+	// modbusExceptionBit is set on the function code of an exception response.
+	modbusExceptionBit byte = 0x80
+)
+
+// ModbusException represents an error response from a device, i.e. a reply
+// whose function code has the high bit set.
+type ModbusException struct {
+	FunctionCode  byte
+	ExceptionCode byte
+}
+
+func (e *ModbusException) Error() string {
+	return fmt.Sprintf("modbus exception: function 0x%02x, code 0x%02x", e.FunctionCode, e.ExceptionCode)
+}
+
+// buildRequestPDU builds a Modbus PDU (function code + payload, no MBAP/CRC
+// framing) for the given feature, using the function code and register
+// address/count carried on the feature map entry. For write function codes,
+// bytes holds the already-encoded register/coil values.
+func buildRequestPDU(funcCode byte, startAddr, quantity uint16, bytes []byte) ([]byte, error) {
+	switch funcCode {
+	case FuncReadCoils, FuncReadDiscreteInputs, FuncReadHoldingRegisters, FuncReadInputRegisters:
+		pdu := make([]byte, 5)
+		pdu[0] = funcCode
+		binary.BigEndian.PutUint16(pdu[1:3], startAddr)
+		binary.BigEndian.PutUint16(pdu[3:5], quantity)
+		return pdu, nil
+	case FuncWriteSingleCoil:
+		pdu := make([]byte, 5)
+		pdu[0] = funcCode
+		binary.BigEndian.PutUint16(pdu[1:3], startAddr)
+		if len(bytes) > 0 && bytes[0] != 0 {
+			pdu[3], pdu[4] = 0xFF, 0x00
+		} else {
+			pdu[3], pdu[4] = 0x00, 0x00
+		}
+		return pdu, nil
+	case FuncWriteSingleRegister:
+		pdu := make([]byte, 5)
+		pdu[0] = funcCode
+		binary.BigEndian.PutUint16(pdu[1:3], startAddr)
+		if len(bytes) < 2 {
+			return nil, fmt.Errorf("write single register requires 2 value bytes, got %d", len(bytes))
+		}
+		pdu[3], pdu[4] = bytes[0], bytes[1]
+		return pdu, nil
+	case FuncWriteMultipleCoils:
+		packed := packCoilBits(bytes)
+		byteCount := (quantity + 7) / 8
+		pdu := make([]byte, 6+byteCount)
+		pdu[0] = funcCode
+		binary.BigEndian.PutUint16(pdu[1:3], startAddr)
+		binary.BigEndian.PutUint16(pdu[3:5], quantity)
+		pdu[5] = byte(byteCount)
+		copy(pdu[6:], packed)
+		return pdu, nil
+	case FuncWriteMultipleRegisters:
+		byteCount := quantity * 2
+		pdu := make([]byte, 6+byteCount)
+		pdu[0] = funcCode
+		binary.BigEndian.PutUint16(pdu[1:3], startAddr)
+		binary.BigEndian.PutUint16(pdu[3:5], quantity)
+		pdu[5] = byte(byteCount)
+		copy(pdu[6:], bytes)
+		return pdu, nil
+	default:
+		return nil, fmt.Errorf("unsupported modbus function code 0x%02x", funcCode)
+	}
+}
+
+// parseResponsePDU strips the function code from a response PDU, returning the
+// remaining payload bytes. It returns a *ModbusException if the device
+// signalled an error (function code with the high bit set).
+func parseResponsePDU(funcCode byte, pdu []byte) ([]byte, error) {
+	if len(pdu) < 1 {
+		return nil, fmt.Errorf("empty modbus response PDU")
+	}
+	respFunc := pdu[0]
+	if respFunc&modbusExceptionBit != 0 {
+		if len(pdu) < 2 {
+			return nil, fmt.Errorf("truncated modbus exception response")
+		}
+		return nil, &ModbusException{FunctionCode: respFunc &^ modbusExceptionBit, ExceptionCode: pdu[1]}
+	}
+	switch respFunc {
+	case FuncReadCoils, FuncReadDiscreteInputs, FuncReadHoldingRegisters, FuncReadInputRegisters:
+		if len(pdu) < 2 {
+			return nil, fmt.Errorf("truncated modbus read response")
+		}
+		byteCount := int(pdu[1])
+		if len(pdu) < 2+byteCount {
+			return nil, fmt.Errorf("modbus read response shorter than declared byte count")
+		}
+		return pdu[2 : 2+byteCount], nil
+	case FuncWriteSingleCoil, FuncWriteSingleRegister, FuncWriteMultipleCoils, FuncWriteMultipleRegisters:
+		// Write responses echo the address/quantity; there is no value payload to decode.
+		return pdu[1:], nil
+	default:
+		return nil, fmt.Errorf("unsupported modbus function code 0x%02x in response", respFunc)
+	}
+}
+
+// packCoilBits packs unpacked coil values (the one-byte-per-coil, zero/nonzero
+// convention encodeValue produces) into the bit-per-coil layout a multiple-coil
+// write PDU requires on the wire.
+func packCoilBits(unpacked []byte) []byte {
+	packed := make([]byte, (len(unpacked)+7)/8)
+	for i, b := range unpacked {
+		if b != 0 {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return packed
+}
+
+// readFunctionCodeForRegisterType picks the read function code for a polled
+// feature by register type. For input and discrete registers this is the same
+// default ConvertIssueMessage2Device applies; for holding registers and coils,
+// ConvertIssueMessage2Device defaults to a write code instead (see
+// functionCodeForRegisterType).
+func readFunctionCodeForRegisterType(registerType string) byte {
+	switch registerType {
+	case models.ModbusRegisterTypeCoil:
+		return FuncReadCoils
+	case models.ModbusRegisterTypeInput:
+		return FuncReadInputRegisters
+	case models.ModbusRegisterTypeDiscrete:
+		return FuncReadDiscreteInputs
+	default: // models.ModbusRegisterTypeHolding
+		return FuncReadHoldingRegisters
+	}
+}
+
+// functionCodeForRegisterType picks a default write function code when the
+// feature map entry does not pin one explicitly, choosing the single-register
+// form unless more than one register/coil is addressed.
+func functionCodeForRegisterType(registerType string, registerNum int) byte {
+	switch registerType {
+	case models.ModbusRegisterTypeCoil:
+		if registerNum > 1 {
+			return FuncWriteMultipleCoils
+		}
+		return FuncWriteSingleCoil
+	default: // models.ModbusRegisterTypeHolding
+		if registerNum > 1 {
+			return FuncWriteMultipleRegisters
+		}
+		return FuncWriteSingleRegister
+	}
+}
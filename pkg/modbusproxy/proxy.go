@@ -0,0 +1,263 @@
+/*
+Copyright 2022 The BeeThings Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package modbusproxy implements a Modbus/TCP gateway that lets third-party
+// Modbus masters (SCADA, engineering tools) talk to devices that are normally
+// only reachable through the beethings device-access stack, by relaying each
+// request through a Transport (see that interface's doc comment for how the
+// converter plugin shares and serializes the underlying connection).
+package modbusproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Transport delivers a raw Modbus request PDU to the device mapped to deviceId
+// and returns the device's raw response PDU. It is satisfied by an adapter
+// around the converter plugin's issue path. Server serializes requests per unit
+// ID only; an implementation whose device connection is also used by other
+// callers serializes access to it itself, as the converter plugin's adapter does.
+type Transport interface {
+	Execute(ctx context.Context, deviceId string, requestPDU []byte) (responsePDU []byte, err error)
+}
+
+// Route maps a Modbus unit identifier, as addressed by an external Modbus/TCP
+// client, to one of the deviceIds known to the device-access stack.
+type Route struct {
+	UnitId   byte
+	DeviceId string
+}
+
+// Config holds the settings needed to start a Server.
+type Config struct {
+	// ListenAddr is the TCP address the Modbus/TCP server listens on, e.g. ":502".
+	ListenAddr string
+	// Routes maps unit IDs to deviceIds. A client request for an unmapped unit ID
+	// is rejected with a gateway-path-unavailable exception.
+	Routes []Route
+	// RequestTimeout bounds how long a single forwarded request may take.
+	RequestTimeout time.Duration
+	// InitialBackoff and MaxBackoff bound the retry backoff applied to a slave
+	// after a failed request, doubling on each consecutive failure.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Modbus/TCP exception codes used for gateway-level failures (as opposed to
+// exceptions returned by the addressed device itself).
+const (
+	excGatewayPathUnavailable       byte = 0x0A
+	excGatewayTargetFailedToRespond byte = 0x0B
+	mbapHeaderLen                   int  = 7
+	modbusExceptionBit              byte = 0x80
+)
+
+// Server is a listening Modbus/TCP gateway that forwards requests to devices
+// via a Transport, queuing at most one in-flight request per slave to respect
+// half-duplex RTU buses.
+type Server struct {
+	cfg       Config
+	transport Transport
+	logger    hclog.Logger
+
+	listener net.Listener
+
+	mu      sync.Mutex
+	slaves  map[byte]*slaveQueue
+	wg      sync.WaitGroup
+	closing chan struct{}
+}
+
+// slaveQueue serializes requests to a single unit ID and tracks backoff state
+// so that a misbehaving slave does not get hammered with retries.
+type slaveQueue struct {
+	deviceId string
+	mu       sync.Mutex
+	backoff  time.Duration
+	until    time.Time
+}
+
+// NewServer constructs a Server. Call Start to begin accepting connections.
+func NewServer(cfg Config, transport Transport, logger hclog.Logger) *Server {
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = 5 * time.Second
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = 200 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Second
+	}
+	slaves := make(map[byte]*slaveQueue, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		slaves[r.UnitId] = &slaveQueue{deviceId: r.DeviceId}
+	}
+	return &Server{
+		cfg:       cfg,
+		transport: transport,
+		logger:    logger,
+		slaves:    slaves,
+		closing:   make(chan struct{}),
+	}
+}
+
+// Start opens the listening socket and begins serving connections in the
+// background. It returns once the listener is bound.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("modbusproxy: listen %s: %w", s.cfg.ListenAddr, err)
+	}
+	s.listener = ln
+	s.wg.Add(1)
+	go s.acceptLoop()
+	s.logger.Info("modbusproxy: listening", "addr", s.cfg.ListenAddr)
+	return nil
+}
+
+// Close stops accepting new connections and waits for in-flight connections
+// to drain.
+func (s *Server) Close() error {
+	close(s.closing)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closing:
+				return
+			default:
+				s.logger.Error("modbusproxy: accept error", "error", err)
+				return
+			}
+		}
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	for {
+		header := make([]byte, mbapHeaderLen)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				s.logger.Debug("modbusproxy: read MBAP header", "error", err)
+			}
+			return
+		}
+		transactionId := binary.BigEndian.Uint16(header[0:2])
+		length := binary.BigEndian.Uint16(header[4:6])
+		unitId := header[6]
+		if length == 0 || length > 253 {
+			s.logger.Error("modbusproxy: invalid MBAP length", "length", length)
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			s.logger.Debug("modbusproxy: read PDU", "error", err)
+			return
+		}
+
+		respPDU, excCode := s.handleRequest(unitId, pdu)
+		if excCode != 0 {
+			// A client may legally send a zero-length PDU (MBAP length == 1); there is no
+			// request function code to echo back in that case, so fall back to 0.
+			var reqFuncCode byte
+			if len(pdu) > 0 {
+				reqFuncCode = pdu[0]
+			}
+			respPDU = []byte{reqFuncCode | modbusExceptionBit, excCode}
+		}
+		if err := writeADU(conn, transactionId, unitId, respPDU); err != nil {
+			s.logger.Debug("modbusproxy: write response", "error", err)
+			return
+		}
+	}
+}
+
+// handleRequest routes pdu to the slave mapped to unitId with concurrency 1,
+// applying backoff if the slave is currently in a cooldown period. It returns
+// either a response PDU or a nonzero gateway exception code.
+func (s *Server) handleRequest(unitId byte, pdu []byte) ([]byte, byte) {
+	s.mu.Lock()
+	slave, ok := s.slaves[unitId]
+	s.mu.Unlock()
+	if !ok {
+		return nil, excGatewayPathUnavailable
+	}
+
+	slave.mu.Lock()
+	defer slave.mu.Unlock()
+
+	if time.Now().Before(slave.until) {
+		return nil, excGatewayTargetFailedToRespond
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.RequestTimeout)
+	defer cancel()
+
+	resp, err := s.transport.Execute(ctx, slave.deviceId, pdu)
+	if err != nil {
+		slave.backoff = nextBackoff(slave.backoff, s.cfg.InitialBackoff, s.cfg.MaxBackoff)
+		slave.until = time.Now().Add(slave.backoff)
+		s.logger.Warn("modbusproxy: transport error", "deviceId", slave.deviceId, "error", err, "backoff", slave.backoff)
+		return nil, excGatewayTargetFailedToRespond
+	}
+	slave.backoff = 0
+	slave.until = time.Time{}
+	return resp, 0
+}
+
+func nextBackoff(current, initial, max time.Duration) time.Duration {
+	if current <= 0 {
+		return initial
+	}
+	next := current * 2
+	if next > max {
+		return max
+	}
+	return next
+}
+
+func writeADU(w io.Writer, transactionId uint16, unitId byte, pdu []byte) error {
+	header := make([]byte, mbapHeaderLen)
+	binary.BigEndian.PutUint16(header[0:2], transactionId)
+	binary.BigEndian.PutUint16(header[2:4], 0) // protocol id is always 0 for Modbus
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(pdu)+1))
+	header[6] = unitId
+	_, err := w.Write(append(header, pdu...))
+	return err
+}
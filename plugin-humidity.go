@@ -17,10 +17,8 @@ limitations under the License.
 package main
 
 import (
-	"encoding/binary"
 	"fmt"
 	"os"
-	"strconv"
 
 	"github.com/beeedge/beethings/pkg/device-access/rest/models"
 	"github.com/beeedge/device-plugin-framework/shared"
@@ -32,6 +30,14 @@ import (
 // Here is a real implementation of device-plugin.
 type Converter struct {
 	logger hclog.Logger
+	// conns is the device connection pool backing ExecuteRawPDU (see proxy.go for how it
+	// serializes access per device).
+	conns *deviceConnPool
+}
+
+// newConverter constructs a Converter with its device connection pool ready to use.
+func newConverter(logger hclog.Logger) *Converter {
+	return &Converter{logger: logger, conns: newDeviceConnPool()}
 }
 
 // ConvertIssueMessage2Device converts issue request to protocol that device understands, which has four return parameters:
@@ -39,6 +45,11 @@ type Converter struct {
 // 2. outputMessages: device data report protocols for each of command output param.
 // 3. issueTopic: device issue MQTT topic for input params.
 // 4. issueResponseTopic: device issue response MQ topic for output params.
+//
+// A mapped feature can carry an explicit Modbus function code (models.DeviceFeatureMap's
+// FunctionCode field) alongside its register type, so reads (FC01/02/03/04) and writes
+// (FC05/06/15/16) are framed as real Modbus PDUs rather than a raw byte blob. When
+// FunctionCode is zero, a default is picked from the register type.
 func (c *Converter) ConvertIssueMessage2Device(deviceId, modelId, featureId string, values map[string]string, convertedDeviceFeatureMap string) ([]string, []string, string, string, error) {
 	var deviceFeatureMap models.DeviceFeatureMap
 	if err := yaml.Unmarshal([]byte(convertedDeviceFeatureMap), &deviceFeatureMap); err != nil {
@@ -50,7 +61,9 @@ func (c *Converter) ConvertIssueMessage2Device(deviceId, modelId, featureId stri
 	if values != nil {
 		for k, value := range values {
 			c.logger.Info("k = %s\n", k)
-			switch deviceFeatureMap.InputParamIdMap[k].RegisterType {
+			param := deviceFeatureMap.InputParamIdMap[k]
+			funcCode := param.FunctionCode
+			switch param.RegisterType {
 			// Single holding registry length is 16bit, so first need to convert the values to multiple of 16 bit.
 			// If len of value longer than num of holding registry * 16 bits, then keep the values shorter than num of holding registry * 16 bits.
 			// If len of value shorter than num of holding registry * 16 bits, compensation zero to reach num of holding registry * 16 bits.
@@ -58,34 +71,68 @@ func (c *Converter) ConvertIssueMessage2Device(deviceId, modelId, featureId stri
 			// Here is a example explain how it works.
 			case models.ModbusRegisterTypeHolding:
 				c.logger.Info("type = %s\n", models.ModbusRegisterTypeHolding)
-				bytes := make([]byte, deviceFeatureMap.InputParamIdMap[k].RegisterNum*2)
-				for i := 0; i < int(deviceFeatureMap.InputParamIdMap[k].RegisterNum*2); i++ {
-					if 2*(i+1)-1 < len(value) {
-						b := value[2*i : 2*(i+1)]
-						v, err := strconv.ParseUint(b, 10, 16)
-						if err != nil {
-							return nil, nil, "", "", err
-						}
-						bytes[i] = uint8(v)
+				if funcCode == 0 {
+					funcCode = functionCodeForRegisterType(param.RegisterType, param.RegisterNum)
+				}
+				if funcCode == FuncReadHoldingRegisters {
+					pdu, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), nil)
+					if err != nil {
+						return nil, nil, "", "", err
 					}
+					return []string{string(pdu)}, nil, "", "", nil
+				}
+				bytes, err := encodeValue(value, param)
+				if err != nil {
+					return nil, nil, "", "", err
 				}
 				c.logger.Info("bytes holding = %s\n", string(bytes))
-				return []string{string(bytes)}, nil, "", "", nil
+				pdu, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), bytes)
+				if err != nil {
+					return nil, nil, "", "", err
+				}
+				return []string{string(pdu)}, nil, "", "", nil
 			case models.ModbusRegisterTypeCoil:
 				c.logger.Info("type = %s\n", models.ModbusRegisterTypeCoil)
-				bytes := make([]byte, deviceFeatureMap.InputParamIdMap[k].RegisterNum)
-				for i := 0; i < int(deviceFeatureMap.InputParamIdMap[k].RegisterNum); i++ {
-					if 2*(i+1)-1 < len(value) {
-						b := value[2*i : 2*(i+1)]
-						v, err := strconv.ParseUint(b, 10, 16)
-						if err != nil {
-							return nil, nil, "", "", err
-						}
-						bytes[i] = uint8(v)
+				if funcCode == 0 {
+					funcCode = functionCodeForRegisterType(param.RegisterType, param.RegisterNum)
+				}
+				if funcCode == FuncReadCoils {
+					pdu, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), nil)
+					if err != nil {
+						return nil, nil, "", "", err
 					}
+					return []string{string(pdu)}, nil, "", "", nil
+				}
+				bytes, err := encodeValue(value, param)
+				if err != nil {
+					return nil, nil, "", "", err
 				}
 				c.logger.Info("bytes coil = %s\n", string(bytes))
-				return []string{string(bytes)}, nil, "", "", nil
+				pdu, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), bytes)
+				if err != nil {
+					return nil, nil, "", "", err
+				}
+				return []string{string(pdu)}, nil, "", "", nil
+			case models.ModbusRegisterTypeInput:
+				c.logger.Info("type = %s\n", models.ModbusRegisterTypeInput)
+				if funcCode == 0 {
+					funcCode = FuncReadInputRegisters
+				}
+				pdu, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), nil)
+				if err != nil {
+					return nil, nil, "", "", err
+				}
+				return []string{string(pdu)}, nil, "", "", nil
+			case models.ModbusRegisterTypeDiscrete:
+				c.logger.Info("type = %s\n", models.ModbusRegisterTypeDiscrete)
+				if funcCode == 0 {
+					funcCode = FuncReadDiscreteInputs
+				}
+				pdu, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), nil)
+				if err != nil {
+					return nil, nil, "", "", err
+				}
+				return []string{string(pdu)}, nil, "", "", nil
 			}
 		}
 	}
@@ -93,33 +140,120 @@ func (c *Converter) ConvertIssueMessage2Device(deviceId, modelId, featureId stri
 }
 
 // ConvertDeviceMessages2MQFormat receives device command issue responses and converts it to RabbitMQ normative format.
+// The response is parsed as a Modbus PDU: an exception response (high-bit function code plus
+// exception byte) is surfaced as a *ModbusException rather than decoded as data. The payload is
+// then run through the typed codec using the feature's DataType/ByteOrder/Scale/Offset.
 func (c *Converter) ConvertDeviceMessages2MQFormat(messages []string, convertedDeviceFeatureMap string) (string, []byte, error) {
-	// Coil registry length is 8bit, so the length is not enough to convert by binary.BigEndian.Uint16(bytes). So we need to compensation zero to make it to 16bit.
-	// Here is a example explain how it works.
 	if messages != nil && len(messages[0]) > 0 {
-		bytes := []byte(messages[0])
-		if len(messages[0]) == 1 {
-			bytes = append(bytes, []byte{0}[0])
+		pdu := []byte(messages[0])
+		payload, err := parseResponsePDU(pdu[0], pdu)
+		if err != nil {
+			return "", nil, err
+		}
+
+		var deviceFeatureMap models.DeviceFeatureMap
+		if err := yaml.Unmarshal([]byte(convertedDeviceFeatureMap), &deviceFeatureMap); err != nil {
+			c.logger.Info("Unmarshal convertedDeviceFeatureMap error: %s\n", err.Error())
+			return "", nil, err
+		}
+		param, ok := firstFeatureMapParam(deviceFeatureMap)
+		if !ok {
+			return "", nil, fmt.Errorf("convertedDeviceFeatureMap has no feature params")
+		}
+
+		data, err := decodeValue(payload, param)
+		if err != nil {
+			return "", nil, err
 		}
-		d := binary.BigEndian.Uint16(bytes)
-		data := strconv.FormatUint(uint64(d), 16)
 		return "", []byte(data), nil
 	}
 	return "", nil, fmt.Errorf("No any messages.")
 }
 
+// firstFeatureMapParam returns the single feature param carried by deviceFeatureMap, since
+// ConvertDeviceMessages2MQFormat is always handed the map for exactly one feature. Output
+// params (read responses) take priority over input params (write acknowledgements).
+func firstFeatureMapParam(deviceFeatureMap models.DeviceFeatureMap) (models.FeatureMapParam, bool) {
+	for _, p := range deviceFeatureMap.OutputParamIdMap {
+		return p, true
+	}
+	for _, p := range deviceFeatureMap.InputParamIdMap {
+		return p, true
+	}
+	return models.FeatureMapParam{}, false
+}
+
+// DryRun builds the exact request PDU that ConvertIssueMessage2Device would send for values
+// and decodes it back with the same codec used on a real device response, without touching
+// hardware. It lets mapping authors iterate on a DeviceFeatureMap definition in unit tests.
+func (c *Converter) DryRun(featureId string, values map[string]string, convertedDeviceFeatureMap string) (requestPDU []byte, roundTrip string, err error) {
+	var deviceFeatureMap models.DeviceFeatureMap
+	if err := yaml.Unmarshal([]byte(convertedDeviceFeatureMap), &deviceFeatureMap); err != nil {
+		return nil, "", fmt.Errorf("DryRun: unmarshal convertedDeviceFeatureMap: %w", err)
+	}
+	value, ok := values[featureId]
+	if !ok {
+		return nil, "", fmt.Errorf("DryRun: no value supplied for featureId %q", featureId)
+	}
+	param, ok := deviceFeatureMap.InputParamIdMap[featureId]
+	if !ok {
+		return nil, "", fmt.Errorf("DryRun: no matching input param for featureId %q", featureId)
+	}
+
+	funcCode := param.FunctionCode
+	if funcCode == 0 {
+		switch param.RegisterType {
+		case models.ModbusRegisterTypeInput, models.ModbusRegisterTypeDiscrete:
+			funcCode = readFunctionCodeForRegisterType(param.RegisterType)
+		default:
+			funcCode = functionCodeForRegisterType(param.RegisterType, param.RegisterNum)
+		}
+	}
+	switch funcCode {
+	case FuncReadCoils, FuncReadDiscreteInputs, FuncReadHoldingRegisters, FuncReadInputRegisters:
+		return nil, "", fmt.Errorf("DryRun: featureId %q is a read (function code 0x%02x), nothing to write", featureId, funcCode)
+	}
+	bytes, err := encodeValue(value, param)
+	if err != nil {
+		return nil, "", err
+	}
+	pdu, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	decoded, err := decodeValue(bytes, param)
+	if err != nil {
+		return nil, "", err
+	}
+	return pdu, decoded, nil
+}
+
 func main() {
 	logger := hclog.New(&hclog.LoggerOptions{
 		Level:      hclog.Trace,
 		Output:     os.Stderr,
 		JSONFormat: true,
 	})
+	if os.Getenv("MODBUS_SIMULATOR_ENABLE") == "true" {
+		if err := runSimulatorMode(logger); err != nil {
+			logger.Error("simulator: failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	converter := newConverter(logger)
+
+	if _, err := maybeStartModbusProxy(logger, converter); err != nil {
+		logger.Error("modbusproxy: failed to start", "error", err)
+	}
+	if err := maybeStartPolling(logger, converter); err != nil {
+		logger.Error("polling: failed to start", "error", err)
+	}
 	plugin.Serve(&plugin.ServeConfig{
 		HandshakeConfig: shared.Handshake,
 		Plugins: map[string]plugin.Plugin{
-			"converter": &shared.ConverterPlugin{Impl: &Converter{
-				logger: logger,
-			}},
+			"converter": &shared.ConverterPlugin{Impl: converter},
 		},
 		// A non-nil value here enables gRPC serving for this plugin...
 		GRPCServer: plugin.DefaultGRPCServer,
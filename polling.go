@@ -0,0 +1,256 @@
+/*
+Copyright 2022 The BeeThings Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beeedge/beethings/pkg/device-access/rest/models"
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/yaml.v2"
+)
+
+// FeatureReader performs a single device read for one polling cycle, returning the raw
+// Modbus response PDU bytes exactly as the plugin would receive them over the normal
+// issue/response path. It is satisfied by deviceIssuePathReader, an adapter around
+// Converter.ExecuteRawPDU.
+type FeatureReader interface {
+	ReadFeature(ctx context.Context, deviceId, modelId, featureId string) (pdu []byte, err error)
+}
+
+// deviceIssuePathReader adapts Converter.ExecuteRawPDU into a FeatureReader, so
+// polling reads go over the same shared connection pool as the Modbus/TCP
+// gateway and any plugin-issued request, rather than a transport of their own.
+type deviceIssuePathReader struct {
+	converter        *Converter
+	deviceFeatureMap models.DeviceFeatureMap
+}
+
+func (r *deviceIssuePathReader) ReadFeature(ctx context.Context, deviceId, modelId, featureId string) ([]byte, error) {
+	param, ok := r.deviceFeatureMap.OutputParamIdMap[featureId]
+	if !ok {
+		param, ok = r.deviceFeatureMap.InputParamIdMap[featureId]
+	}
+	if !ok {
+		return nil, fmt.Errorf("deviceIssuePathReader: unknown featureId %q", featureId)
+	}
+	funcCode := param.FunctionCode
+	if funcCode == 0 {
+		funcCode = readFunctionCodeForRegisterType(param.RegisterType)
+	}
+	reqPDU, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.converter.ExecuteRawPDU(ctx, deviceId, reqPDU)
+}
+
+// PollEvent is one change-of-value (or heartbeat) sample emitted by a polling subscription
+// and handed to StartPolling's send callback.
+type PollEvent struct {
+	FeatureId string
+	Payload   []byte
+	Heartbeat bool
+}
+
+// heartbeatInterval is how often a feature's current value is re-emitted even when it has
+// not moved by more than deadband, so subscribers can detect a stalled feed.
+const heartbeatInterval = 60 * time.Second
+
+// StartPolling runs the change-of-value polling loop. It is a plain Go method, not a gRPC
+// method of shared.ConverterPlugin: events go to send, and maybeStartPolling is its only
+// caller in this plugin. It schedules one read per
+// feature in featureIds at intervalMs (plus jitter, so features sharing an interval do not
+// all hit the bus at once), decodes each response with the typed codec, and invokes send
+// only when the decoded value has moved by more than deadband or the heartbeat interval has
+// elapsed. All per-feature polling stops when ctx is cancelled (plugin shutdown).
+func (c *Converter) StartPolling(ctx context.Context, reader FeatureReader, deviceId, modelId string, featureIds []string, intervalMs int, deadband float64, convertedDeviceFeatureMap string, send func(PollEvent) error) error {
+	if intervalMs <= 0 {
+		return fmt.Errorf("StartPolling: intervalMs must be positive, got %d", intervalMs)
+	}
+	var deviceFeatureMap models.DeviceFeatureMap
+	if err := yaml.Unmarshal([]byte(convertedDeviceFeatureMap), &deviceFeatureMap); err != nil {
+		return fmt.Errorf("StartPolling: unmarshal convertedDeviceFeatureMap: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, featureId := range featureIds {
+		param, ok := deviceFeatureMap.OutputParamIdMap[featureId]
+		if !ok {
+			param, ok = deviceFeatureMap.InputParamIdMap[featureId]
+		}
+		if !ok {
+			c.logger.Warn("StartPolling: unknown featureId, skipping", "featureId", featureId)
+			continue
+		}
+		featureId, param := featureId, param
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.pollFeature(ctx, reader, deviceId, modelId, featureId, param, intervalMs, deadband, send)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// pollFeature runs the read/decode/compare loop for a single feature until ctx is cancelled
+// or send returns an error. It does not serialize its reader.ReadFeature calls against other
+// features on the same device itself - for the deviceIssuePathReader, that serialization is
+// Converter.ExecuteRawPDU's job (see proxy.go's deviceConnPool), so every poll and gateway
+// request to the same device queues for the one connection instead of each caller taking an
+// independent, uncoordinated lock.
+func (c *Converter) pollFeature(ctx context.Context, reader FeatureReader, deviceId, modelId, featureId string, param models.FeatureMapParam, intervalMs int, deadband float64, send func(PollEvent) error) {
+	interval := time.Duration(intervalMs) * time.Millisecond
+	var lastValue string
+	var lastSentAt time.Time
+	haveLast := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval + jitter(interval)):
+		}
+
+		pdu, err := reader.ReadFeature(ctx, deviceId, modelId, featureId)
+		if err != nil {
+			c.logger.Warn("StartPolling: read failed", "deviceId", deviceId, "featureId", featureId, "error", err)
+			continue
+		}
+		if len(pdu) == 0 {
+			c.logger.Warn("StartPolling: read returned an empty PDU, skipping", "deviceId", deviceId, "featureId", featureId)
+			continue
+		}
+
+		payload, err := parseResponsePDU(pdu[0], pdu)
+		if err != nil {
+			c.logger.Warn("StartPolling: parse response failed", "deviceId", deviceId, "featureId", featureId, "error", err)
+			continue
+		}
+		value, err := decodeValue(payload, param)
+		if err != nil {
+			c.logger.Warn("StartPolling: decode failed", "deviceId", deviceId, "featureId", featureId, "error", err)
+			continue
+		}
+
+		changed := !haveLast || valueChanged(lastValue, value, deadband)
+		heartbeatDue := haveLast && time.Since(lastSentAt) >= heartbeatInterval
+		if !changed && !heartbeatDue {
+			continue
+		}
+
+		if err := send(PollEvent{FeatureId: featureId, Payload: []byte(value), Heartbeat: !changed && heartbeatDue}); err != nil {
+			c.logger.Error("StartPolling: send failed, stopping feature poll", "featureId", featureId, "error", err)
+			return
+		}
+		lastValue, lastSentAt, haveLast = value, time.Now(), true
+	}
+}
+
+// valueChanged reports whether two decoded values differ by more than deadband. Non-numeric
+// values (e.g. string data types) are reported as changed whenever they differ textually.
+func valueChanged(prev, next string, deadband float64) bool {
+	prevF, errPrev := strconv.ParseFloat(prev, 64)
+	nextF, errNext := strconv.ParseFloat(next, 64)
+	if errPrev != nil || errNext != nil {
+		return prev != next
+	}
+	diff := nextF - prevF
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff > deadband
+}
+
+// jitter returns a random duration up to 10% of interval, spreading out polls that share the
+// same interval so they do not all hit the bus in lockstep.
+func jitter(interval time.Duration) time.Duration {
+	max := interval / 10
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// maybeStartPolling starts the optional change-of-value polling subscription when
+// MODBUS_POLLING_ENABLE is set, letting operators opt in to telemetry for a device
+// that has no inbound report path of its own. Reads go through deviceIssuePathReader,
+// which shares converter's connection pool with the rest of the plugin (see proxy.go).
+// It returns nil immediately when polling is disabled; otherwise it runs StartPolling
+// in the background until the process exits.
+func maybeStartPolling(logger hclog.Logger, converter *Converter) error {
+	if os.Getenv("MODBUS_POLLING_ENABLE") != "true" {
+		return nil
+	}
+	deviceId := os.Getenv("MODBUS_POLLING_DEVICE_ID")
+	modelId := os.Getenv("MODBUS_POLLING_MODEL_ID")
+	deviceAddr := os.Getenv("MODBUS_POLLING_DEVICE_ADDR")
+	featureMapPath := os.Getenv("MODBUS_POLLING_FEATURE_MAP")
+	featureIdsCSV := os.Getenv("MODBUS_POLLING_FEATURE_IDS")
+	if deviceId == "" || deviceAddr == "" || featureMapPath == "" || featureIdsCSV == "" {
+		return fmt.Errorf("polling: MODBUS_POLLING_DEVICE_ID, MODBUS_POLLING_DEVICE_ADDR, MODBUS_POLLING_FEATURE_MAP and MODBUS_POLLING_FEATURE_IDS must all be set")
+	}
+	featureIds := strings.Split(featureIdsCSV, ",")
+
+	intervalMs, err := strconv.Atoi(envOrDefault("MODBUS_POLLING_INTERVAL_MS", "1000"))
+	if err != nil {
+		return fmt.Errorf("polling: parse MODBUS_POLLING_INTERVAL_MS: %w", err)
+	}
+	deadband, err := strconv.ParseFloat(envOrDefault("MODBUS_POLLING_DEADBAND", "0"), 64)
+	if err != nil {
+		return fmt.Errorf("polling: parse MODBUS_POLLING_DEADBAND: %w", err)
+	}
+
+	featureMapData, err := os.ReadFile(featureMapPath)
+	if err != nil {
+		return fmt.Errorf("polling: read feature map: %w", err)
+	}
+	var deviceFeatureMap models.DeviceFeatureMap
+	if err := yaml.Unmarshal(featureMapData, &deviceFeatureMap); err != nil {
+		return fmt.Errorf("polling: unmarshal feature map: %w", err)
+	}
+
+	converter.conns.registerAddr(deviceId, deviceAddr)
+	reader := &deviceIssuePathReader{converter: converter, deviceFeatureMap: deviceFeatureMap}
+
+	go func() {
+		send := func(event PollEvent) error {
+			logger.Info("polling: feature value", "deviceId", deviceId, "featureId", event.FeatureId, "value", string(event.Payload), "heartbeat", event.Heartbeat)
+			return nil
+		}
+		if err := converter.StartPolling(context.Background(), reader, deviceId, modelId, featureIds, intervalMs, deadband, string(featureMapData), send); err != nil {
+			logger.Error("polling: StartPolling exited", "error", err)
+		}
+	}()
+	return nil
+}
+
+// envOrDefault returns the named environment variable, or def if it is unset or empty.
+func envOrDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2022 The BeeThings Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/beeedge/dpf-modbus-demo/pkg/modbusproxy"
+	"github.com/hashicorp/go-hclog"
+)
+
+// deviceConnPool hands out one persistent connection per deviceId, shared by every caller
+// in the process: the Modbus/TCP gateway (pkg/modbusproxy), polling subscriptions, and any
+// plugin-issued request all go through Converter.ExecuteRawPDU, which is the single place
+// that dials and serializes access to a device's connection. That serialization, not just
+// connection reuse, is what makes it safe to share: deviceConn.mu covers each write+read
+// pair as one atomic unit, so two callers hitting the same deviceId concurrently queue for
+// the bus instead of interleaving their requests/responses on the wire. Callers must not
+// keep their own separate per-device lock for this purpose (see StartPolling) - a second,
+// uncoordinated lock guarding the same connection provides no real exclusion.
+type deviceConnPool struct {
+	mu    sync.Mutex
+	addrs map[string]string
+	conns map[string]*deviceConn
+}
+
+// deviceConn pairs a dialed connection with the mutex that serializes requests on it.
+type deviceConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newDeviceConnPool() *deviceConnPool {
+	return &deviceConnPool{addrs: make(map[string]string), conns: make(map[string]*deviceConn)}
+}
+
+// registerAddr records the dial address for a deviceId. Safe to call before or after the
+// pool has already dialed other devices.
+func (p *deviceConnPool) registerAddr(deviceId, addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addrs[deviceId] = addr
+}
+
+// get returns the shared connection wrapper for deviceId, dialing it on first use.
+// Concurrent callers racing to dial the same never-yet-connected device are resolved so
+// only one connection wins; the loser's socket is closed rather than kept open alongside it.
+func (p *deviceConnPool) get(ctx context.Context, deviceId string) (*deviceConn, error) {
+	p.mu.Lock()
+	if dc, ok := p.conns[deviceId]; ok {
+		p.mu.Unlock()
+		return dc, nil
+	}
+	addr, ok := p.addrs[deviceId]
+	p.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no transport address registered for device %q", deviceId)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial device %q at %s: %w", deviceId, addr, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.conns[deviceId]; ok {
+		conn.Close()
+		return existing, nil
+	}
+	dc := &deviceConn{conn: conn}
+	p.conns[deviceId] = dc
+	return dc, nil
+}
+
+// invalidate drops and closes deviceId's cached connection, but only if dc is still the
+// current one - a concurrent get may already have redialed and replaced it, in which case
+// there is nothing to close here.
+func (p *deviceConnPool) invalidate(deviceId string, dc *deviceConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.conns[deviceId]; ok && existing == dc {
+		existing.conn.Close()
+		delete(p.conns, deviceId)
+	}
+}
+
+// ExecuteRawPDU sends requestPDU to deviceId over the converter's shared connection pool
+// and returns the device's raw response PDU. It is the plugin's single issue-path entry
+// point at the transport level: pkg/modbusproxy's gateway and StartPolling's subscriptions
+// both call it instead of dialing or locking their own connection, so every request to a
+// given device - regardless of which subsystem issued it - is serialized through the same
+// deviceConn.mu.
+func (c *Converter) ExecuteRawPDU(ctx context.Context, deviceId string, requestPDU []byte) ([]byte, error) {
+	if c.conns == nil {
+		return nil, fmt.Errorf("ExecuteRawPDU: converter has no device connection pool configured")
+	}
+	dc, err := c.conns.get(ctx, deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		dc.conn.SetDeadline(deadline)
+	}
+	if _, err := dc.conn.Write(requestPDU); err != nil {
+		c.conns.invalidate(deviceId, dc)
+		return nil, fmt.Errorf("ExecuteRawPDU: write to device %q: %w", deviceId, err)
+	}
+	resp := make([]byte, 256)
+	n, err := dc.conn.Read(resp)
+	if err != nil && err != io.EOF {
+		c.conns.invalidate(deviceId, dc)
+		return nil, fmt.Errorf("ExecuteRawPDU: read from device %q: %w", deviceId, err)
+	}
+	if n == 0 {
+		// A zero-byte read (whether or not accompanied by io.EOF) means the peer closed
+		// the connection without sending a response; treat it as a failure rather than
+		// handing callers a successful empty PDU they cannot safely index into.
+		c.conns.invalidate(deviceId, dc)
+		return nil, fmt.Errorf("ExecuteRawPDU: device %q closed the connection with no response", deviceId)
+	}
+	return resp[:n], nil
+}
+
+// deviceTransport adapts Converter.ExecuteRawPDU to the modbusproxy.Transport interface.
+type deviceTransport struct {
+	converter *Converter
+}
+
+func (t *deviceTransport) Execute(ctx context.Context, deviceId string, requestPDU []byte) ([]byte, error) {
+	return t.converter.ExecuteRawPDU(ctx, deviceId, requestPDU)
+}
+
+// modbusProxyRouteConfig is the shape of one entry in the MODBUS_PROXY_ROUTES JSON env
+// var, e.g. [{"unitId":1,"deviceId":"dev-1","addr":"127.0.0.1:5021"}].
+type modbusProxyRouteConfig struct {
+	UnitId   byte   `json:"unitId"`
+	DeviceId string `json:"deviceId"`
+	Addr     string `json:"addr"`
+}
+
+// maybeStartModbusProxy starts the optional Modbus/TCP gateway when MODBUS_PROXY_ENABLE is
+// set, letting operators opt in to third-party Modbus master access without a separate
+// binary. Routed deviceIds' dial addresses are registered on converter's shared connection
+// pool, so the gateway relays through the same connection the rest of the plugin uses. It
+// returns a nil server and nil error when the proxy is disabled.
+func maybeStartModbusProxy(logger hclog.Logger, converter *Converter) (*modbusproxy.Server, error) {
+	if os.Getenv("MODBUS_PROXY_ENABLE") != "true" {
+		return nil, nil
+	}
+	listenAddr := os.Getenv("MODBUS_PROXY_LISTEN_ADDR")
+	if listenAddr == "" {
+		listenAddr = ":502"
+	}
+
+	var routeCfgs []modbusProxyRouteConfig
+	if err := json.Unmarshal([]byte(os.Getenv("MODBUS_PROXY_ROUTES")), &routeCfgs); err != nil {
+		return nil, fmt.Errorf("modbusproxy: parse MODBUS_PROXY_ROUTES: %w", err)
+	}
+
+	routes := make([]modbusproxy.Route, 0, len(routeCfgs))
+	for _, rc := range routeCfgs {
+		routes = append(routes, modbusproxy.Route{UnitId: rc.UnitId, DeviceId: rc.DeviceId})
+		converter.conns.registerAddr(rc.DeviceId, rc.Addr)
+	}
+
+	server := modbusproxy.NewServer(modbusproxy.Config{
+		ListenAddr: listenAddr,
+		Routes:     routes,
+	}, &deviceTransport{converter: converter}, logger)
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2022 The BeeThings Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/beeedge/beethings/pkg/device-access/rest/models"
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/yaml.v2"
+)
+
+// simulatorFixture seeds a simulatedDevice's register contents for offline testing of a
+// convertedDeviceFeatureMap, without needing real hardware.
+type simulatorFixture struct {
+	DeviceId  string                     `yaml:"deviceId"`
+	Registers []simulatorFixtureRegister `yaml:"registers"`
+}
+
+type simulatorFixtureRegister struct {
+	RegisterType string `yaml:"registerType"`
+	Address      uint16 `yaml:"address"`
+	// Values holds the raw register/coil bytes to seed, two bytes per holding/input
+	// register or one byte (0/1) per coil/discrete input.
+	Values []byte `yaml:"values"`
+}
+
+// simulatedDevice is an in-process Modbus slave whose register contents come from a
+// simulatorFixture. It answers read/write PDUs the same way buildRequestPDU/parseResponsePDU
+// expect a real device to, so responses can be routed back through
+// Converter.ConvertDeviceMessages2MQFormat unmodified.
+type simulatedDevice struct {
+	registers map[string]map[uint16]byte
+}
+
+func newSimulatedDeviceFromFixture(data []byte) (*simulatedDevice, error) {
+	var fixture simulatorFixture
+	if err := yaml.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("simulator: unmarshal fixture: %w", err)
+	}
+	dev := &simulatedDevice{registers: make(map[string]map[uint16]byte)}
+	for _, reg := range fixture.Registers {
+		if dev.registers[reg.RegisterType] == nil {
+			dev.registers[reg.RegisterType] = make(map[uint16]byte)
+		}
+		for i, b := range reg.Values {
+			dev.registers[reg.RegisterType][reg.Address+uint16(i)] = b
+		}
+	}
+	return dev, nil
+}
+
+// Handle answers a single request PDU against the simulated register map, returning a
+// response PDU shaped exactly like a real device's (or a *ModbusException for a request
+// shorter than 5 bytes or an unsupported function code). Addresses that were never seeded
+// or written read as zero.
+func (d *simulatedDevice) Handle(requestPDU []byte) ([]byte, error) {
+	if len(requestPDU) < 5 {
+		return nil, &ModbusException{FunctionCode: 0, ExceptionCode: 0x03}
+	}
+	funcCode := requestPDU[0]
+	addr := uint16(requestPDU[1])<<8 | uint16(requestPDU[2])
+
+	switch funcCode {
+	case FuncReadCoils, FuncReadDiscreteInputs, FuncReadHoldingRegisters, FuncReadInputRegisters:
+		quantity := uint16(requestPDU[3])<<8 | uint16(requestPDU[4])
+		regType := registerTypeForFunctionCode(funcCode)
+		data, err := d.readBytes(regType, addr, quantity, funcCode == FuncReadCoils || funcCode == FuncReadDiscreteInputs)
+		if err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 2+len(data))
+		resp[0] = funcCode
+		resp[1] = byte(len(data))
+		copy(resp[2:], data)
+		return resp, nil
+	case FuncWriteSingleCoil, FuncWriteSingleRegister, FuncWriteMultipleCoils, FuncWriteMultipleRegisters:
+		regType := models.ModbusRegisterTypeHolding
+		if funcCode == FuncWriteSingleCoil || funcCode == FuncWriteMultipleCoils {
+			regType = models.ModbusRegisterTypeCoil
+		}
+		if d.registers[regType] == nil {
+			d.registers[regType] = make(map[uint16]byte)
+		}
+		switch funcCode {
+		case FuncWriteSingleCoil:
+			if requestPDU[3] != 0 {
+				d.registers[regType][addr] = 1
+			} else {
+				d.registers[regType][addr] = 0
+			}
+		case FuncWriteSingleRegister:
+			d.registers[regType][addr] = requestPDU[3]
+			d.registers[regType][addr+1] = requestPDU[4]
+		case FuncWriteMultipleCoils:
+			quantity := uint16(requestPDU[3])<<8 | uint16(requestPDU[4])
+			for i, packed := range requestPDU[6:] {
+				for bit := 0; bit < 8 && uint16(i*8+bit) < quantity; bit++ {
+					coil := addr + uint16(i*8+bit)
+					if packed&(1<<uint(bit)) != 0 {
+						d.registers[regType][coil] = 1
+					} else {
+						d.registers[regType][coil] = 0
+					}
+				}
+			}
+		default: // FuncWriteMultipleRegisters
+			for i, b := range requestPDU[6:] {
+				d.registers[regType][addr+uint16(i)] = b
+			}
+		}
+		// Write responses echo the address/quantity (or value, for single writes) from the request.
+		resp := make([]byte, 5)
+		copy(resp, requestPDU[:5])
+		return resp, nil
+	default:
+		return nil, &ModbusException{FunctionCode: funcCode, ExceptionCode: 0x01}
+	}
+}
+
+func (d *simulatedDevice) readBytes(regType string, addr, quantity uint16, perAddrByte bool) ([]byte, error) {
+	reg := d.registers[regType]
+	if perAddrByte {
+		count := (quantity + 7) / 8
+		out := make([]byte, count)
+		for i := uint16(0); i < quantity; i++ {
+			if reg[addr+i] != 0 {
+				out[i/8] |= 1 << (i % 8)
+			}
+		}
+		return out, nil
+	}
+	out := make([]byte, quantity*2)
+	for i := uint16(0); i < quantity; i++ {
+		out[i*2] = reg[addr+i*2]
+		out[i*2+1] = reg[addr+i*2+1]
+	}
+	return out, nil
+}
+
+func registerTypeForFunctionCode(funcCode byte) string {
+	switch funcCode {
+	case FuncReadCoils:
+		return models.ModbusRegisterTypeCoil
+	case FuncReadDiscreteInputs:
+		return models.ModbusRegisterTypeDiscrete
+	case FuncReadInputRegisters:
+		return models.ModbusRegisterTypeInput
+	default:
+		return models.ModbusRegisterTypeHolding
+	}
+}
+
+// runSimulatorMode stands up an in-process simulatedDevice seeded from
+// MODBUS_SIMULATOR_FIXTURE, reads every feature in MODBUS_SIMULATOR_FEATURE_MAP's
+// OutputParamIdMap, and logs the value ConvertDeviceMessages2MQFormat decodes for each,
+// so mapping authors can validate a convertedDeviceFeatureMap yaml without hardware.
+func runSimulatorMode(logger hclog.Logger) error {
+	fixturePath := os.Getenv("MODBUS_SIMULATOR_FIXTURE")
+	featureMapPath := os.Getenv("MODBUS_SIMULATOR_FEATURE_MAP")
+	if fixturePath == "" || featureMapPath == "" {
+		return fmt.Errorf("simulator: MODBUS_SIMULATOR_FIXTURE and MODBUS_SIMULATOR_FEATURE_MAP must both be set")
+	}
+
+	fixtureData, err := os.ReadFile(fixturePath)
+	if err != nil {
+		return fmt.Errorf("simulator: read fixture: %w", err)
+	}
+	dev, err := newSimulatedDeviceFromFixture(fixtureData)
+	if err != nil {
+		return err
+	}
+
+	featureMapData, err := os.ReadFile(featureMapPath)
+	if err != nil {
+		return fmt.Errorf("simulator: read feature map: %w", err)
+	}
+	var deviceFeatureMap models.DeviceFeatureMap
+	if err := yaml.Unmarshal(featureMapData, &deviceFeatureMap); err != nil {
+		return fmt.Errorf("simulator: unmarshal feature map: %w", err)
+	}
+
+	converter := newConverter(logger)
+	for featureId, param := range deviceFeatureMap.OutputParamIdMap {
+		funcCode := param.FunctionCode
+		if funcCode == 0 {
+			funcCode = FuncReadHoldingRegisters
+			switch param.RegisterType {
+			case models.ModbusRegisterTypeCoil:
+				funcCode = FuncReadCoils
+			case models.ModbusRegisterTypeInput:
+				funcCode = FuncReadInputRegisters
+			case models.ModbusRegisterTypeDiscrete:
+				funcCode = FuncReadDiscreteInputs
+			}
+		}
+		reqPDU, err := buildRequestPDU(funcCode, param.RegisterAddr, uint16(param.RegisterNum), nil)
+		if err != nil {
+			logger.Error("simulator: build request failed", "featureId", featureId, "error", err)
+			continue
+		}
+		respPDU, err := dev.Handle(reqPDU)
+		if err != nil {
+			logger.Error("simulator: device returned exception", "featureId", featureId, "error", err)
+			continue
+		}
+		singleYAML, err := yaml.Marshal(models.DeviceFeatureMap{OutputParamIdMap: map[string]models.FeatureMapParam{featureId: param}})
+		if err != nil {
+			return fmt.Errorf("simulator: marshal single-feature map: %w", err)
+		}
+		_, payload, err := converter.ConvertDeviceMessages2MQFormat([]string{string(respPDU)}, string(singleYAML))
+		if err != nil {
+			logger.Error("simulator: decode failed", "featureId", featureId, "error", err)
+			continue
+		}
+		logger.Info("simulator: feature value", "featureId", featureId, "value", string(payload))
+	}
+	return nil
+}